@@ -3,13 +3,14 @@ package prometheus
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 
-	"k8s.io/apimachinery/pkg/labels"
-	kcorelisters "k8s.io/kubernetes/pkg/client/listers/core/v1"
+	kapi "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"github.com/openshift/origin/pkg/apps/util"
 )
@@ -18,145 +19,606 @@ const (
 	completeRolloutCount         = "complete_rollouts_total"
 	activeRolloutDurationSeconds = "active_rollouts_duration_seconds"
 	lastFailedRolloutTime        = "last_failed_rollout_time"
+	lastFailedRolloutInfo        = "last_failed_rollout_info"
+	rolloutDurationSeconds       = "rollout_duration_seconds"
+	failedRolloutsTotal          = "failed_rollouts_total"
+	triggerActivationsTotal      = "trigger_activations_total"
+
+	defaultNamespace = "openshift_apps"
+	defaultSubsystem = "deploymentconfigs"
 
 	availablePhase = "available"
 	failedPhase    = "failed"
 	cancelledPhase = "cancelled"
+
+	// deploymentStrategyAnnotation mirrors the annotation set by the deployer
+	// controller on the replication controller it creates for a rollout.
+	deploymentStrategyAnnotation = "openshift.io/deployment.strategy"
+	unknownStrategy              = "Unknown"
+
+	// statusReasonAnnotation carries why a deployment reached a terminal
+	// status, set by the deployer controller (e.g. "timeout", "hook-failed").
+	statusReasonAnnotation = "openshift.io/deployment.status-reason"
+	cancelledReason        = "cancelled-by-user"
+	unknownReason          = "Unknown"
+
+	// triggerCauseAnnotation carries the type of trigger (ConfigChange or
+	// ImageChange) that caused the deployer controller to start a rollout.
+	triggerCauseAnnotation = "openshift.io/deployment.trigger"
 )
 
-var (
-	nameToQuery = func(name string) string {
-		return strings.Join([]string{"openshift_apps_deploymentconfigs", name}, "_")
-	}
+// Exported names for the metric families below, for use as keys in
+// CollectorOptions.DisabledMetrics so callers don't have to hardcode string
+// literals that can silently typo into a no-op.
+const (
+	MetricCompleteRolloutsTotal        = completeRolloutCount
+	MetricActiveRolloutDurationSeconds = activeRolloutDurationSeconds
+	MetricLastFailedRolloutTime        = lastFailedRolloutTime
+	MetricLastFailedRolloutInfo        = lastFailedRolloutInfo
+	MetricRolloutDurationSeconds       = rolloutDurationSeconds
+	MetricFailedRolloutsTotal          = failedRolloutsTotal
+	MetricTriggerActivationsTotal      = triggerActivationsTotal
+)
 
-	completeRolloutCountDesc = prometheus.NewDesc(
-		nameToQuery(completeRolloutCount),
-		"Counts total complete rollouts",
-		[]string{"phase"}, nil,
-	)
+// knownMetricNames is every valid CollectorOptions.DisabledMetrics key, used
+// to catch typos instead of silently disabling nothing.
+var knownMetricNames = map[string]bool{
+	MetricCompleteRolloutsTotal:        true,
+	MetricActiveRolloutDurationSeconds: true,
+	MetricLastFailedRolloutTime:        true,
+	MetricLastFailedRolloutInfo:        true,
+	MetricRolloutDurationSeconds:       true,
+	MetricFailedRolloutsTotal:          true,
+	MetricTriggerActivationsTotal:      true,
+}
 
-	lastFailedRolloutTimeDesc = prometheus.NewDesc(
-		nameToQuery(lastFailedRolloutTime),
-		"Tracks the time of last failure rollout per deployment config",
-		[]string{"namespace", "name", "generation"}, nil,
-	)
+// rolloutDurationSecondsBuckets covers rollouts from a few seconds up to an hour.
+var rolloutDurationSecondsBuckets = []float64{15, 30, 60, 120, 300, 600, 900, 1800, 3600}
 
-	activeRolloutDurationSecondsDesc = prometheus.NewDesc(
-		nameToQuery(activeRolloutDurationSeconds),
-		"Tracks the active rollout duration in seconds",
-		[]string{"namespace", "name", "phase", "generation"}, nil,
-	)
+// CollectorOptions configures the metric names and which metric families a
+// Collector exposes. The zero value is a valid CollectorOptions: Namespace
+// and Subsystem fall back to the historical "openshift_apps_deploymentconfigs"
+// names, every metric family is enabled, and RolloutDurationBuckets falls
+// back to rolloutDurationSecondsBuckets.
+type CollectorOptions struct {
+	Namespace string
+	Subsystem string
 
-	apps       = appsCollector{}
-	registered = false
-)
+	// DisabledMetrics lists metric family names (the constants above, e.g.
+	// activeRolloutDurationSeconds) that the Collector neither describes nor
+	// collects; the per-rollout state behind a disabled family is not kept
+	// either, while the aggregate counts behind complete_rollouts_total are
+	// always maintained. Use this to opt out of expensive high-cardinality series such
+	// as active_rollouts_duration_seconds, which is labeled by
+	// namespace/name/generation, analogous to node_exporter's per-collector
+	// enable/disable flags.
+	DisabledMetrics map[string]bool
 
-type appsCollector struct {
-	lister kcorelisters.ReplicationControllerLister
+	// RolloutDurationBuckets overrides the default histogram buckets used by
+	// the rollout_duration_seconds metric.
+	RolloutDurationBuckets []float64
 }
 
-func IntializeMetricsCollector(rcLister kcorelisters.ReplicationControllerLister) {
-	apps.lister = rcLister
-	if !registered {
-		prometheus.MustRegister(&apps)
-		registered = true
+func (o CollectorOptions) withDefaults() CollectorOptions {
+	if len(o.Namespace) == 0 {
+		o.Namespace = defaultNamespace
+	}
+	if len(o.Subsystem) == 0 {
+		o.Subsystem = defaultSubsystem
+	}
+	if o.DisabledMetrics == nil {
+		o.DisabledMetrics = map[string]bool{}
+	}
+	if len(o.RolloutDurationBuckets) == 0 {
+		o.RolloutDurationBuckets = rolloutDurationSecondsBuckets
 	}
-	glog.V(4).Info("apps metrics registered with prometheus")
+	return o
 }
 
-func (c *appsCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- completeRolloutCountDesc
-	ch <- activeRolloutDurationSecondsDesc
+func (o CollectorOptions) enabled(name string) bool {
+	return !o.DisabledMetrics[name]
+}
+
+// validateDisabledMetrics logs a warning for every DisabledMetrics key that
+// doesn't name a real metric family, since a typo there would otherwise
+// silently fail to disable anything.
+func (o CollectorOptions) validateDisabledMetrics() {
+	for name, disabled := range o.DisabledMetrics {
+		if disabled && !knownMetricNames[name] {
+			glog.Warningf("apps metrics: DisabledMetrics contains unknown metric name %q, ignoring", name)
+		}
+	}
 }
 
+// rolloutCategory buckets a replication controller into one of the terminal
+// phases tracked by the complete_rollouts_total metric, or activeCategory
+// while the rollout is still in progress.
+type rolloutCategory string
+
+const (
+	activeCategory    rolloutCategory = "active"
+	availableCategory rolloutCategory = availablePhase
+	failedCategory    rolloutCategory = failedPhase
+	cancelledCategory rolloutCategory = cancelledPhase
+)
+
 type failedRollout struct {
 	timestamp  float64
 	generation int64
+	reason     string
+}
+
+// activeRollout is the bounded per-rollout state kept while a deployment is
+// in progress, so Collect only has to walk active rollouts instead of every
+// replication controller in the cluster.
+type activeRollout struct {
+	namespace, name   string
+	phase             string
+	generation        int64
+	creationTimestamp time.Time
+}
+
+// snapshot is a point-in-time copy of the state handleReplicationController
+// maintains, taken under Collector.mu so metricFamily.collect funcs can run
+// without holding the lock while they write to the scrape channel.
+type snapshot struct {
+	available, failed, cancelled float64
+	activeRollouts               map[string]activeRollout
+	latestFailedRollouts         map[string]failedRollout
+}
+
+// metricFamily is one entry in Collector.families: a metric name paired with
+// the describe/collect funcs that emit it. Collector.Describe and
+// Collector.Collect iterate this slice generically instead of every metric
+// getting its own hand-written enabled-or-not guard at every call site.
+// Building the slice is the single place that reads CollectorOptions; once
+// built, a disabled metric simply isn't in the slice.
+type metricFamily struct {
+	name     string
+	describe func(ch chan<- *prometheus.Desc)
+	collect  func(ch chan<- prometheus.Metric, snap snapshot)
+}
+
+// Collector implements prometheus.Collector for openshift apps deployment
+// config rollouts. Construct one with NewCollector and register it with
+// whatever prometheus.Registry the caller wants it visible on.
+type Collector struct {
+	options  CollectorOptions
+	families []metricFamily
+
+	// rcInformer.HasSynced is used to tell a genuinely new replication
+	// controller from one the informer is merely replaying during its
+	// initial List on startup/restart: AddFunc fires for both, but only the
+	// former is a real trigger activation.
+	rcInformer cache.SharedIndexInformer
+
+	// rolloutDurationSeconds is observed from a controller-side event hook
+	// whenever a rollout reaches a terminal phase (Complete/Failed/Cancelled),
+	// rather than recomputed on every scrape like the gauges below. It is nil
+	// when disabled via CollectorOptions.
+	rolloutDurationSeconds *prometheus.HistogramVec
+	// failedRolloutsTotal is incremented once per terminal Failed deployment,
+	// labeled by the reason it failed and the strategy it used. Nil when disabled.
+	failedRolloutsTotal *prometheus.CounterVec
+	// triggerActivationsTotal is incremented once per rollout first observed
+	// while active after the informer has synced and carrying a trigger
+	// annotation, labeled by the trigger (ConfigChange/ImageChange) that
+	// started it. Nil when disabled.
+	triggerActivationsTotal *prometheus.CounterVec
+	// activeRolloutDurationSecondsDesc is non-nil only when that metric family
+	// is enabled; handleReplicationController uses its nilness to decide
+	// whether to bother tracking active rollouts at all.
+	activeRolloutDurationSecondsDesc *prometheus.Desc
+	// lastFailedRolloutTimeDesc and lastFailedRolloutInfoDesc are non-nil only
+	// when the corresponding metric family is enabled.
+	lastFailedRolloutTimeDesc *prometheus.Desc
+	lastFailedRolloutInfoDesc *prometheus.Desc
+
+	mu sync.Mutex
+	// rcCategories tracks the last known category of every replication
+	// controller we have seen, keyed by namespace/name, so updates can adjust
+	// the aggregate counters incrementally instead of re-tallying everything.
+	rcCategories         map[string]rolloutCategory
+	available            float64
+	failed               float64
+	cancelled            float64
+	activeRollouts       map[string]activeRollout
+	latestFailedRollouts map[string]failedRollout
+}
+
+// NewCollector builds a Collector wired up to the replication controller
+// informer, so that the rollout counters are maintained incrementally from
+// watch events instead of being recomputed by listing every replication
+// controller on each scrape. The caller is responsible for registering the
+// returned Collector, e.g. with prometheus.MustRegister.
+func NewCollector(rcInformer cache.SharedIndexInformer, options CollectorOptions) *Collector {
+	options = options.withDefaults()
+	options.validateDisabledMetrics()
+
+	c := &Collector{
+		options:    options,
+		rcInformer: rcInformer,
+
+		rcCategories:         map[string]rolloutCategory{},
+		activeRollouts:       map[string]activeRollout{},
+		latestFailedRollouts: map[string]failedRollout{},
+	}
+
+	if options.enabled(completeRolloutCount) {
+		desc := prometheus.NewDesc(
+			prometheus.BuildFQName(options.Namespace, options.Subsystem, completeRolloutCount),
+			"Counts total complete rollouts",
+			[]string{"phase"}, nil,
+		)
+		c.families = append(c.families, metricFamily{
+			name:     completeRolloutCount,
+			describe: func(ch chan<- *prometheus.Desc) { ch <- desc },
+			collect: func(ch chan<- prometheus.Metric, snap snapshot) {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, snap.available, []string{availablePhase}...)
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, snap.failed, []string{failedPhase}...)
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, snap.cancelled, []string{cancelledPhase}...)
+			},
+		})
+	}
+
+	if options.enabled(activeRolloutDurationSeconds) {
+		desc := prometheus.NewDesc(
+			prometheus.BuildFQName(options.Namespace, options.Subsystem, activeRolloutDurationSeconds),
+			"Tracks the active rollout duration in seconds",
+			[]string{"namespace", "name", "phase", "generation"}, nil,
+		)
+		c.activeRolloutDurationSecondsDesc = desc
+		c.families = append(c.families, metricFamily{
+			name:     activeRolloutDurationSeconds,
+			describe: func(ch chan<- *prometheus.Desc) { ch <- desc },
+			collect: func(ch chan<- prometheus.Metric, snap snapshot) {
+				for _, r := range snap.activeRollouts {
+					// TODO: possible time screw?
+					durationSeconds := time.Now().Sub(r.creationTimestamp).Seconds()
+					ch <- prometheus.MustNewConstMetric(
+						desc,
+						prometheus.CounterValue,
+						durationSeconds,
+						[]string{r.namespace, r.name, r.phase, fmt.Sprintf("%d", r.generation)}...)
+				}
+			},
+		})
+	}
+
+	if options.enabled(lastFailedRolloutTime) {
+		desc := prometheus.NewDesc(
+			prometheus.BuildFQName(options.Namespace, options.Subsystem, lastFailedRolloutTime),
+			"Tracks the time of last failure rollout per deployment config",
+			[]string{"namespace", "name", "generation"}, nil,
+		)
+		c.lastFailedRolloutTimeDesc = desc
+		c.families = append(c.families, metricFamily{
+			name:     lastFailedRolloutTime,
+			describe: func(ch chan<- *prometheus.Desc) { ch <- desc },
+			collect: func(ch chan<- prometheus.Metric, snap snapshot) {
+				for dc, r := range snap.latestFailedRollouts {
+					parts := strings.Split(dc, "/")
+					ch <- prometheus.MustNewConstMetric(
+						desc,
+						prometheus.GaugeValue,
+						r.timestamp,
+						[]string{parts[0], parts[1], fmt.Sprintf("%d", r.generation)}...)
+				}
+			},
+		})
+	}
+
+	if options.enabled(lastFailedRolloutInfo) {
+		desc := prometheus.NewDesc(
+			prometheus.BuildFQName(options.Namespace, options.Subsystem, lastFailedRolloutInfo),
+			"Tracks the time of the last failed rollout per deployment config, together with the generation and reason it failed. Use time() - this metric to alert on deployment configs stuck failing.",
+			[]string{"namespace", "name", "generation", "reason"}, nil,
+		)
+		c.lastFailedRolloutInfoDesc = desc
+		c.families = append(c.families, metricFamily{
+			name:     lastFailedRolloutInfo,
+			describe: func(ch chan<- *prometheus.Desc) { ch <- desc },
+			collect: func(ch chan<- prometheus.Metric, snap snapshot) {
+				for dc, r := range snap.latestFailedRollouts {
+					parts := strings.Split(dc, "/")
+					ch <- prometheus.MustNewConstMetric(
+						desc,
+						prometheus.GaugeValue,
+						r.timestamp,
+						[]string{parts[0], parts[1], fmt.Sprintf("%d", r.generation), r.reason}...)
+				}
+			},
+		})
+	}
+
+	if options.enabled(rolloutDurationSeconds) {
+		c.rolloutDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      rolloutDurationSeconds,
+			Help:      "Tracks the duration in seconds of rollouts that reached a terminal phase, labeled by strategy and phase",
+			Buckets:   options.RolloutDurationBuckets,
+		}, []string{"namespace", "strategy", "phase"})
+		c.families = append(c.families, metricFamily{
+			name:     rolloutDurationSeconds,
+			describe: c.rolloutDurationSeconds.Describe,
+			collect:  func(ch chan<- prometheus.Metric, snap snapshot) { c.rolloutDurationSeconds.Collect(ch) },
+		})
+	}
+
+	if options.enabled(failedRolloutsTotal) {
+		c.failedRolloutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      failedRolloutsTotal,
+			Help:      "Counts the total number of failed rollouts, labeled by failure reason and strategy",
+		}, []string{"namespace", "name", "reason", "strategy"})
+		c.families = append(c.families, metricFamily{
+			name:     failedRolloutsTotal,
+			describe: c.failedRolloutsTotal.Describe,
+			collect:  func(ch chan<- prometheus.Metric, snap snapshot) { c.failedRolloutsTotal.Collect(ch) },
+		})
+	}
+
+	if options.enabled(triggerActivationsTotal) {
+		c.triggerActivationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: options.Namespace,
+			Subsystem: options.Subsystem,
+			Name:      triggerActivationsTotal,
+			Help:      "Counts the total number of rollouts started by each trigger type",
+		}, []string{"namespace", "name", "trigger_type"})
+		c.families = append(c.families, metricFamily{
+			name:     triggerActivationsTotal,
+			describe: c.triggerActivationsTotal.Describe,
+			collect:  func(ch chan<- prometheus.Metric, snap snapshot) { c.triggerActivationsTotal.Collect(ch) },
+		})
+	}
+
+	rcInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.handleReplicationController,
+		UpdateFunc: func(old, cur interface{}) { c.handleReplicationController(cur) },
+		DeleteFunc: c.handleReplicationControllerDelete,
+	})
+
+	glog.V(4).Info("apps metrics collector created")
+	return c
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, f := range c.families {
+		f.describe(ch)
+	}
+}
+
+// RecordRolloutDuration observes the duration of a rollout that just reached a
+// terminal phase (Complete/Failed/Cancelled). handleReplicationController calls
+// it from the informer's event handler when a rollout moves into a terminal
+// phase, not from Collect, since the transition only happens once per rollout
+// and would otherwise be missed between scrapes.
+func (c *Collector) RecordRolloutDuration(d *kapi.ReplicationController, phase string) {
+	if c.rolloutDurationSeconds == nil {
+		return
+	}
+	dcName := util.DeploymentConfigNameFor(d)
+	if len(dcName) == 0 {
+		return
+	}
+	duration := time.Now().Sub(d.CreationTimestamp.Time).Seconds()
+	c.rolloutDurationSeconds.WithLabelValues(d.Namespace, strategyFor(d), phase).Observe(duration)
+}
+
+// strategyFor returns the deployment strategy recorded on the replication
+// controller, falling back to "Unknown" when the annotation is missing.
+func strategyFor(d *kapi.ReplicationController) string {
+	if strategy, ok := d.Annotations[deploymentStrategyAnnotation]; ok && len(strategy) > 0 {
+		return strategy
+	}
+	return unknownStrategy
+}
+
+// failureReasonFor returns why a deployment failed, preferring the
+// deployer-set status-reason annotation and falling back to the cancellation
+// reason or "Unknown" rather than parsing the human-readable status message.
+func failureReasonFor(d *kapi.ReplicationController) string {
+	if reason, ok := d.Annotations[statusReasonAnnotation]; ok && len(reason) > 0 {
+		return reason
+	}
+	if util.IsDeploymentCancelled(d) {
+		return cancelledReason
+	}
+	return unknownReason
+}
+
+// triggerTypeFor returns the trigger (ConfigChange/ImageChange) that started
+// the rollout, if the deployer controller recorded one.
+func triggerTypeFor(d *kapi.ReplicationController) (string, bool) {
+	triggerType, ok := d.Annotations[triggerCauseAnnotation]
+	if !ok || len(triggerType) == 0 {
+		return "", false
+	}
+	return triggerType, true
 }
 
-// Collect implements the prometheus.Collector interface.
-func (c *appsCollector) Collect(ch chan<- prometheus.Metric) {
-	result, err := c.lister.List(labels.Everything())
-	if err != nil {
-		glog.V(4).Infof("Collecting metrics for apps failed: %v", err)
+// categorize classifies a replication controller into a rolloutCategory and,
+// for active rollouts, the phase string reported on activeRolloutDurationSecondsDesc.
+func categorize(d *kapi.ReplicationController) (rolloutCategory, string) {
+	if util.IsTerminatedDeployment(d) {
+		if util.IsDeploymentCancelled(d) {
+			return cancelledCategory, ""
+		}
+		if util.IsFailedDeployment(d) {
+			return failedCategory, ""
+		}
+		if util.IsCompleteDeployment(d) {
+			return availableCategory, ""
+		}
+	}
+
+	// TODO: Figure out under what circumstances the phase is not set.
+	phase := strings.ToLower(string(util.DeploymentStatusFor(d)))
+	if len(phase) == 0 {
+		phase = "unknown"
+	}
+	return activeCategory, phase
+}
+
+// handleReplicationController is invoked by the informer on every add/update
+// of a replication controller and moves the aggregate counters from the
+// rollout's previous category to its current one.
+func (c *Collector) handleReplicationController(obj interface{}) {
+	d, ok := obj.(*kapi.ReplicationController)
+	if !ok {
+		return
+	}
+	dcName := util.DeploymentConfigNameFor(d)
+	if len(dcName) == 0 {
 		return
 	}
 
-	var available, failed, cancelled float64
+	key := d.Namespace + "/" + d.Name
+	category, phase := categorize(d)
 
-	latestFailedRollouts := map[string]failedRollout{}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for _, d := range result {
-		dcName := util.DeploymentConfigNameFor(d)
-		if len(dcName) == 0 {
-			continue
+	oldCategory, known := c.rcCategories[key]
+	c.adjustCategory(oldCategory, -1)
+	c.adjustCategory(category, 1)
+	c.rcCategories[key] = category
+
+	// c.rcInformer.HasSynced guards against the same restart hazard chunk0-1's
+	// fix (d88baff) addressed for rollout_duration_seconds/failed_rollouts_total:
+	// on process restart the informer's initial List() redelivers every
+	// already-active replication controller via AddFunc with known=false, which
+	// would otherwise look identical to a brand new rollout starting. Unlike
+	// those two metrics, a genuinely new rollout's *first ever* observation is
+	// exactly the event this metric wants to count, so requiring known (as
+	// those fixes did) would also suppress the legitimate case; HasSynced
+	// distinguishes "redelivered during startup replay" from "really just
+	// added" without that tradeoff.
+	if !known && category == activeCategory && c.triggerActivationsTotal != nil && c.rcInformer.HasSynced() {
+		if triggerType, ok := triggerTypeFor(d); ok {
+			c.triggerActivationsTotal.WithLabelValues(d.Namespace, dcName, triggerType).Inc()
 		}
+	}
 
-		if util.IsTerminatedDeployment(d) {
-			if util.IsDeploymentCancelled(d) {
-				cancelled++
-				continue
-			}
-			if util.IsFailedDeployment(d) {
-				failed++
-
-				// Track the latest failed rollout per deployment config
-				shouldUpdate := false
-				if r, exists := latestFailedRollouts[d.Namespace+"/"+dcName]; exists {
-					if d.Status.ObservedGeneration > r.generation {
-						shouldUpdate = true
-					}
-				}
-				if shouldUpdate {
-					latestFailedRollouts[d.Namespace+"/"+dcName] = failedRollout{
-						timestamp:  float64(d.CreationTimestamp.Unix()),
-						generation: d.Status.ObservedGeneration,
-					}
-				}
-				continue
-			}
-			if util.IsCompleteDeployment(d) {
-				available++
-				continue
+	if category == activeCategory {
+		if c.activeRolloutDurationSecondsDesc != nil {
+			c.activeRollouts[key] = activeRollout{
+				namespace:         d.Namespace,
+				name:              dcName,
+				phase:             phase,
+				generation:        d.Status.ObservedGeneration,
+				creationTimestamp: d.CreationTimestamp.Time,
 			}
 		}
+		return
+	}
+	delete(c.activeRollouts, key)
+
+	if known && oldCategory != category {
+		c.RecordRolloutDuration(d, string(category))
+	}
+
+	if category != failedCategory {
+		return
+	}
+
+	if known && oldCategory != failedCategory && c.failedRolloutsTotal != nil {
+		c.failedRolloutsTotal.WithLabelValues(d.Namespace, dcName, failureReasonFor(d), strategyFor(d)).Inc()
+	}
+
+	if c.lastFailedRolloutTimeDesc == nil && c.lastFailedRolloutInfoDesc == nil {
+		return
+	}
+
+	// Track the latest failed rollout per deployment config: insert the first
+	// failure we see, and otherwise only move forward to a newer generation.
+	dcKey := d.Namespace + "/" + dcName
+	if r, exists := c.latestFailedRollouts[dcKey]; !exists || d.Status.ObservedGeneration > r.generation {
+		c.latestFailedRollouts[dcKey] = failedRollout{
+			timestamp:  float64(d.CreationTimestamp.Unix()),
+			generation: d.Status.ObservedGeneration,
+			reason:     failureReasonFor(d),
+		}
+	}
+}
 
-		// TODO: Figure out under what circumstances the phase is not set.
-		phase := strings.ToLower(string(util.DeploymentStatusFor(d)))
-		if len(phase) == 0 {
-			phase = "unknown"
+// handleReplicationControllerDelete removes a deleted replication controller
+// from the aggregate counters so it doesn't linger indefinitely.
+func (c *Collector) handleReplicationControllerDelete(obj interface{}) {
+	d, ok := obj.(*kapi.ReplicationController)
+	if !ok {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			d, ok = tombstone.Obj.(*kapi.ReplicationController)
+			if !ok {
+				return
+			}
+		} else {
+			return
 		}
+	}
+
+	key := d.Namespace + "/" + d.Name
+	dcName := util.DeploymentConfigNameFor(d)
 
-		// Record duration in seconds for active rollouts
-		// TODO: possible time screw?
-		durationSeconds := time.Now().Unix() - d.CreationTimestamp.Unix()
-		ch <- prometheus.MustNewConstMetric(
-			activeRolloutDurationSecondsDesc,
-			prometheus.CounterValue,
-			float64(durationSeconds),
-			[]string{
-				d.Namespace,
-				dcName,
-				phase,
-				fmt.Sprintf("%d", d.Status.ObservedGeneration),
-			}...)
-	}
-
-	// Record latest failed rollouts
-	for dc, r := range latestFailedRollouts {
-		parts := strings.Split(dc, "/")
-		ch <- prometheus.MustNewConstMetric(
-			lastFailedRolloutTimeDesc,
-			prometheus.GaugeValue,
-			r.timestamp,
-			[]string{
-				parts[0],
-				parts[1],
-				fmt.Sprintf("%d", r.generation),
-			}...)
-	}
-
-	ch <- prometheus.MustNewConstMetric(completeRolloutCountDesc, prometheus.GaugeValue, available, []string{availablePhase}...)
-	ch <- prometheus.MustNewConstMetric(completeRolloutCountDesc, prometheus.GaugeValue, failed, []string{failedPhase}...)
-	ch <- prometheus.MustNewConstMetric(completeRolloutCountDesc, prometheus.GaugeValue, cancelled, []string{cancelledPhase}...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.adjustCategory(c.rcCategories[key], -1)
+	delete(c.rcCategories, key)
+	delete(c.activeRollouts, key)
+
+	if len(dcName) == 0 {
+		return
+	}
+	// Only clear the recorded last-failed-rollout if this is the replication
+	// controller it was recorded from; a newer generation may have since
+	// replaced it and must not be clobbered by the old one's deletion.
+	dcKey := d.Namespace + "/" + dcName
+	if r, exists := c.latestFailedRollouts[dcKey]; exists && r.generation == d.Status.ObservedGeneration {
+		delete(c.latestFailedRollouts, dcKey)
+	}
+}
+
+// adjustCategory moves the aggregate counter for category by delta. It is a
+// no-op for the activeCategory, which has no aggregate counter of its own.
+func (c *Collector) adjustCategory(category rolloutCategory, delta float64) {
+	switch category {
+	case availableCategory:
+		c.available += delta
+	case failedCategory:
+		c.failed += delta
+	case cancelledCategory:
+		c.cancelled += delta
+	}
+}
+
+// Collect implements the prometheus.Collector interface. Unlike the original
+// implementation it does not list every replication controller on each
+// scrape: the aggregate counters and the bounded active/failed rollout state
+// are maintained incrementally by the informer event handlers above, so
+// Collect only has to copy the state under the lock and hand it to each
+// enabled metricFamily's collect func, none of which hold c.mu while writing
+// to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	snap := snapshot{
+		available:            c.available,
+		failed:               c.failed,
+		cancelled:            c.cancelled,
+		activeRollouts:       make(map[string]activeRollout, len(c.activeRollouts)),
+		latestFailedRollouts: make(map[string]failedRollout, len(c.latestFailedRollouts)),
+	}
+	for k, v := range c.activeRollouts {
+		snap.activeRollouts[k] = v
+	}
+	for k, v := range c.latestFailedRollouts {
+		snap.latestFailedRollouts[k] = v
+	}
+	c.mu.Unlock()
+
+	for _, f := range c.families {
+		f.collect(ch, snap)
+	}
 }
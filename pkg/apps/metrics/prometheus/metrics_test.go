@@ -0,0 +1,355 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	kapi "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The annotation keys below mirror the ones pkg/apps/util uses to classify a
+// replication controller's rollout phase. They are duplicated here, rather
+// than imported, only because this package's util dependency isn't available
+// in this tree snapshot; production code must keep using util's helpers.
+const (
+	testDeploymentConfigAnnotation    = "openshift.io/deployment-config.name"
+	testDeploymentStatusAnnotation    = "openshift.io/deployment.phase"
+	testDeploymentCancelledAnnotation = "openshift.io/deployment.cancelled"
+
+	testPhaseNew      = "New"
+	testPhaseRunning  = "Running"
+	testPhaseComplete = "Complete"
+	testPhaseFailed   = "Failed"
+)
+
+// fakeInformer satisfies cache.SharedIndexInformer by embedding the nil
+// interface and overriding only the methods NewCollector and
+// handleReplicationController call; every test below drives the collector by
+// invoking the handler methods directly, exactly as the real informer would
+// on an add/update/delete event. synced stands in for whether the informer
+// has finished its initial List(), which handleReplicationController uses to
+// tell a genuinely new replication controller from one merely being
+// replayed on startup.
+type fakeInformer struct {
+	cache.SharedIndexInformer
+	synced bool
+}
+
+func (f *fakeInformer) AddEventHandler(handler cache.ResourceEventHandlerFuncs) {}
+func (f *fakeInformer) HasSynced() bool                                         { return f.synced }
+
+// newTestCollector returns a Collector as it would look once the informer's
+// initial List() has completed, i.e. during steady-state operation.
+func newTestCollector(options CollectorOptions) *Collector {
+	return NewCollector(&fakeInformer{synced: true}, options)
+}
+
+// newRestartingTestCollector returns a Collector as it would look while the
+// informer is still replaying its initial List(), i.e. immediately after a
+// process restart, before any event can be considered a genuinely new one.
+func newRestartingTestCollector(options CollectorOptions) *Collector {
+	return NewCollector(&fakeInformer{synced: false}, options)
+}
+
+func newRC(namespace, name, dcName, phase string, generation int64, cancelled bool, created time.Time) *kapi.ReplicationController {
+	annotations := map[string]string{
+		testDeploymentConfigAnnotation: dcName,
+		testDeploymentStatusAnnotation: phase,
+	}
+	if cancelled {
+		annotations[testDeploymentCancelledAnnotation] = "true"
+	}
+	return &kapi.ReplicationController{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			Annotations:       annotations,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Status: kapi.ReplicationControllerStatus{
+			ObservedGeneration: generation,
+		},
+	}
+}
+
+func histogramSampleCount(t *testing.T, hv *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	m, err := hv.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		t.Fatalf("GetMetricWithLabelValues(%v): %v", labels, err)
+	}
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return out.GetHistogram().GetSampleCount()
+}
+
+// TestHandleReplicationController_RecordsRolloutDuration covers chunk0-1:
+// rollout_duration_seconds should gain exactly one observation the moment a
+// rollout first reaches a terminal phase, and no more on subsequent updates.
+func TestHandleReplicationController_RecordsRolloutDuration(t *testing.T) {
+	cases := []struct {
+		name      string
+		phase     string
+		cancelled bool
+		category  rolloutCategory
+	}{
+		{name: "complete", phase: testPhaseComplete, category: availableCategory},
+		{name: "failed", phase: testPhaseFailed, category: failedCategory},
+		{name: "cancelled", phase: testPhaseFailed, cancelled: true, category: cancelledCategory},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(CollectorOptions{})
+			created := time.Now().Add(-time.Minute)
+
+			active := newRC("ns", "dc-1-1", "dc", testPhaseRunning, 1, false, created)
+			c.handleReplicationController(active)
+
+			terminal := newRC("ns", "dc-1-1", "dc", tc.phase, 1, tc.cancelled, created)
+			c.handleReplicationController(terminal)
+
+			if got := histogramSampleCount(t, c.rolloutDurationSeconds, "ns", unknownStrategy, string(tc.category)); got != 1 {
+				t.Fatalf("expected 1 observation after reaching %s, got %d", tc.category, got)
+			}
+
+			// A second update in the same terminal category must not observe again.
+			c.handleReplicationController(terminal)
+			if got := histogramSampleCount(t, c.rolloutDurationSeconds, "ns", unknownStrategy, string(tc.category)); got != 1 {
+				t.Fatalf("expected observation count to stay at 1 after a repeat update, got %d", got)
+			}
+		})
+	}
+}
+
+// TestHandleReplicationController_FirstObservationAlreadyTerminal guards
+// against the informer resync case: the first AddFunc a process sees for a
+// replication controller it has no prior rcCategories entry for can already
+// be in a terminal phase (e.g. on process restart, or the informer's initial
+// List()). That must not be treated as a fresh transition into the terminal
+// phase, or rollout_duration_seconds and failed_rollouts_total would be
+// polluted/double-counted every time the process restarts.
+func TestHandleReplicationController_FirstObservationAlreadyTerminal(t *testing.T) {
+	c := newTestCollector(CollectorOptions{})
+	created := time.Now().Add(-time.Hour)
+
+	failed := newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created)
+	c.handleReplicationController(failed)
+
+	if got := histogramSampleCount(t, c.rolloutDurationSeconds, "ns", unknownStrategy, string(failedCategory)); got != 0 {
+		t.Fatalf("expected no rollout_duration_seconds observation for an already-terminal first observation, got %d", got)
+	}
+	if got := testutil.ToFloat64(c.failedRolloutsTotal.WithLabelValues("ns", "dc", unknownReason, unknownStrategy)); got != 0 {
+		t.Fatalf("expected no failed_rollouts_total increment for an already-terminal first observation, got %v", got)
+	}
+	if c.failed != 1 {
+		t.Fatalf("expected the aggregate failed gauge to still reflect the RC's current state, got %v", c.failed)
+	}
+}
+
+// TestHandleReplicationController_AggregateCounters covers chunk0-2: add,
+// update and delete events driven directly through the handler funcs the
+// informer registers should move the aggregate gauges incrementally.
+func TestHandleReplicationController_AggregateCounters(t *testing.T) {
+	c := newTestCollector(CollectorOptions{})
+	created := time.Now().Add(-time.Minute)
+
+	rc := newRC("ns", "dc-1-1", "dc", testPhaseRunning, 1, false, created)
+	c.handleReplicationController(rc)
+	if c.available != 0 || c.failed != 0 || c.cancelled != 0 {
+		t.Fatalf("active rollout should not affect terminal aggregates, got available=%v failed=%v cancelled=%v", c.available, c.failed, c.cancelled)
+	}
+
+	complete := newRC("ns", "dc-1-1", "dc", testPhaseComplete, 1, false, created)
+	c.handleReplicationController(complete)
+	if c.available != 1 {
+		t.Fatalf("expected available=1 after completing, got %v", c.available)
+	}
+
+	// failed_rollouts_total only counts a transition into Failed, so the
+	// rollout must be seen active first (see FirstObservationAlreadyTerminal).
+	c.handleReplicationController(newRC("ns", "dc-2-1", "dc2", testPhaseRunning, 1, false, created))
+	failed := newRC("ns", "dc-2-1", "dc2", testPhaseFailed, 1, false, created)
+	c.handleReplicationController(failed)
+	if c.failed != 1 {
+		t.Fatalf("expected failed=1, got %v", c.failed)
+	}
+	if got := testutil.ToFloat64(c.failedRolloutsTotal.WithLabelValues("ns", "dc2", unknownReason, unknownStrategy)); got != 1 {
+		t.Fatalf("expected failed_rollouts_total=1, got %v", got)
+	}
+
+	c.handleReplicationControllerDelete(failed)
+	if c.failed != 0 {
+		t.Fatalf("expected failed=0 after delete, got %v", c.failed)
+	}
+	if _, exists := c.latestFailedRollouts["ns/dc2"]; exists {
+		t.Fatalf("expected latestFailedRollouts entry to be removed on delete")
+	}
+
+	// A tombstone delete (the object was already gone from the store by the
+	// time we observed its deletion) must be handled the same way.
+	available := c.available
+	c.handleReplicationControllerDelete(cache.DeletedFinalStateUnknown{Key: "ns/dc-1-1", Obj: complete})
+	if c.available != available-1 {
+		t.Fatalf("expected tombstone delete to decrement available, got %v", c.available)
+	}
+}
+
+// TestHandleReplicationController_LatestFailedRollout covers chunk0-4: first
+// failure, later-generation updates, out-of-order generations, and
+// independent tracking of multiple deployment configs in the same namespace.
+func TestHandleReplicationController_LatestFailedRollout(t *testing.T) {
+	created := time.Now().Add(-time.Minute)
+
+	t.Run("first failure is recorded", func(t *testing.T) {
+		c := newTestCollector(CollectorOptions{})
+		rc := newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created)
+		c.handleReplicationController(rc)
+
+		r, ok := c.latestFailedRollouts["ns/dc"]
+		if !ok || r.generation != 1 {
+			t.Fatalf("expected a generation 1 failure to be recorded, got %+v (ok=%v)", r, ok)
+		}
+	})
+
+	t.Run("later generation replaces earlier", func(t *testing.T) {
+		c := newTestCollector(CollectorOptions{})
+		c.handleReplicationController(newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created))
+		c.handleReplicationController(newRC("ns", "dc-1-2", "dc", testPhaseFailed, 2, false, created))
+
+		if r := c.latestFailedRollouts["ns/dc"]; r.generation != 2 {
+			t.Fatalf("expected generation 2 to replace generation 1, got %+v", r)
+		}
+	})
+
+	t.Run("out of order generation does not regress", func(t *testing.T) {
+		c := newTestCollector(CollectorOptions{})
+		c.handleReplicationController(newRC("ns", "dc-1-2", "dc", testPhaseFailed, 2, false, created))
+		c.handleReplicationController(newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created))
+
+		if r := c.latestFailedRollouts["ns/dc"]; r.generation != 2 {
+			t.Fatalf("expected generation 2 to be kept despite a later-arriving generation 1 event, got %+v", r)
+		}
+	})
+
+	t.Run("multiple deployment configs in the same namespace are independent", func(t *testing.T) {
+		c := newTestCollector(CollectorOptions{})
+		c.handleReplicationController(newRC("ns", "dc-a-1", "dc-a", testPhaseFailed, 1, false, created))
+		c.handleReplicationController(newRC("ns", "dc-b-1", "dc-b", testPhaseFailed, 1, false, created))
+
+		if _, ok := c.latestFailedRollouts["ns/dc-a"]; !ok {
+			t.Fatalf("expected dc-a failure to be tracked")
+		}
+		if _, ok := c.latestFailedRollouts["ns/dc-b"]; !ok {
+			t.Fatalf("expected dc-b failure to be tracked independently of dc-a")
+		}
+	})
+}
+
+// TestFailureReasonFor covers chunk0-3: the status-reason annotation takes
+// precedence, cancellation is the fallback when it's absent, and an
+// unannotated failure reports unknownReason.
+func TestFailureReasonFor(t *testing.T) {
+	created := time.Now().Add(-time.Minute)
+
+	cases := []struct {
+		name   string
+		rc     *kapi.ReplicationController
+		reason string
+	}{
+		{
+			name:   "status-reason annotation present",
+			rc:     newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created),
+			reason: "timeout",
+		},
+		{
+			name:   "cancelled, no status-reason annotation",
+			rc:     newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, true, created),
+			reason: cancelledReason,
+		},
+		{
+			name:   "no status-reason annotation, not cancelled",
+			rc:     newRC("ns", "dc-1-1", "dc", testPhaseFailed, 1, false, created),
+			reason: unknownReason,
+		},
+	}
+
+	cases[0].rc.Annotations[statusReasonAnnotation] = "timeout"
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := failureReasonFor(tc.rc); got != tc.reason {
+				t.Fatalf("expected reason %q, got %q", tc.reason, got)
+			}
+		})
+	}
+}
+
+// TestHandleReplicationController_TriggerActivations covers chunk0-3:
+// trigger_activations_total is incremented once, labeled by trigger type,
+// the first time a genuinely new rollout is observed, and is not incremented
+// again when the informer merely replays an already-active rollout during
+// its initial List() on restart.
+func TestHandleReplicationController_TriggerActivations(t *testing.T) {
+	created := time.Now().Add(-time.Minute)
+
+	cases := []struct {
+		name        string
+		triggerType string
+	}{
+		{name: "ConfigChange", triggerType: "ConfigChange"},
+		{name: "ImageChange", triggerType: "ImageChange"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(CollectorOptions{})
+			rc := newRC("ns", "dc-1-1", "dc", testPhaseRunning, 1, false, created)
+			rc.Annotations[triggerCauseAnnotation] = tc.triggerType
+			c.handleReplicationController(rc)
+
+			if got := testutil.ToFloat64(c.triggerActivationsTotal.WithLabelValues("ns", "dc", tc.triggerType)); got != 1 {
+				t.Fatalf("expected trigger_activations_total=1 for %s, got %v", tc.triggerType, got)
+			}
+		})
+	}
+
+	t.Run("restart does not double-count an already-active rollout", func(t *testing.T) {
+		c := newRestartingTestCollector(CollectorOptions{})
+		rc := newRC("ns", "dc-1-1", "dc", testPhaseRunning, 1, false, created)
+		rc.Annotations[triggerCauseAnnotation] = "ConfigChange"
+		c.handleReplicationController(rc)
+
+		if got := testutil.ToFloat64(c.triggerActivationsTotal.WithLabelValues("ns", "dc", "ConfigChange")); got != 0 {
+			t.Fatalf("expected trigger_activations_total to stay at 0 for a replayed already-active rollout, got %v", got)
+		}
+	})
+}
+
+// TestCollectorOptions_DisabledMetrics covers chunk0-5: disabling a metric
+// family removes it from Describe/Collect. The warning validateDisabledMetrics
+// logs for an unrecognized key is not checked here.
+func TestCollectorOptions_DisabledMetrics(t *testing.T) {
+	c := newTestCollector(CollectorOptions{DisabledMetrics: map[string]bool{
+		MetricRolloutDurationSeconds: true,
+		MetricCompleteRolloutsTotal:  true,
+	}})
+	if c.rolloutDurationSeconds != nil {
+		t.Fatalf("expected rollout_duration_seconds to be disabled")
+	}
+	// complete_rollouts_total unconditionally emits an available/failed/cancelled
+	// const metric on every Collect regardless of activity, so it must also be
+	// disabled here for the collector to report zero series.
+	if got := testutil.CollectAndCount(c); got != 0 {
+		t.Fatalf("expected no series from a fresh collector with no activity, got %d", got)
+	}
+}